@@ -1,16 +1,27 @@
 package main
 
 import (
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"os"
 	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/restic/restic/internal/debug"
 	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/filter"
 	"github.com/restic/restic/internal/repository"
 	"github.com/restic/restic/internal/restic"
 	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
 )
 
 var cmdRewrite = &cobra.Command{
@@ -25,6 +36,35 @@ but using --add-tag option, tags can be added to new snapshots to distinguish th
 
 When no snapshot-ID is given, all snapshots matching the host, tag and path filter criteria are modified.
 
+The --rename flag moves files and directories within the snapshot instead of
+excluding them, which is useful to fix up paths of data that was backed up
+from a since-relocated mount point without having to back it up again. It
+takes an OLD=NEW pair (can be specified multiple times) where OLD may contain
+the same glob patterns as --exclude. Renaming is applied after excludes, so a
+path that is excluded is never considered for renaming.
+
+The --include, --iinclude and --include-file flags work like their --exclude
+counterparts, but invert the match: only items matching at least one include
+pattern are kept, everything else is excluded. They can be combined freely
+with --exclude and --filter.
+
+The --filter flag accepts a boolean expression over the fields "path",
+"size", "mtime", "uid", "gid" and "type", for example:
+
+    --filter 'mtime < 2020-01-01 && size > 100M && !path matches "**/.cache/**"'
+
+Items for which the expression evaluates to true are excluded.
+
+Subtrees that are shared between several snapshots (the common case for
+repositories with many similar snapshots) are only rewritten once per run.
+The --rewrite-concurrency flag controls how many subtrees are processed in
+parallel.
+
+With the global --json flag, "rewrite" streams one JSON object per line
+(snapshot_checked, node_excluded, tree_rewritten, snapshot_saved,
+snapshot_forgotten) followed by a final summary object, instead of the
+human-readable progress output.
+
 Please note, that this command only creates new snapshots. In order to delete
 data from repository you may use the --forget and --prune flag.
 
@@ -57,6 +97,16 @@ type RewriteOptions struct {
 	ExcludeFiles            []string
 	InsensitiveExcludeFiles []string
 	ExcludeLargerThan       string
+
+	Includes            []string
+	InsensitiveIncludes []string
+	IncludeFiles        []string
+
+	Filter string
+
+	Renames []string
+
+	Concurrency int
 }
 
 var rewriteOptions RewriteOptions
@@ -70,6 +120,14 @@ func init() {
 	f.StringArrayVar(&rewriteOptions.ExcludeFiles, "exclude-file", nil, "read exclude patterns from a `file` (can be specified multiple times)")
 	f.StringArrayVar(&rewriteOptions.InsensitiveExcludeFiles, "iexclude-file", nil, "same as --exclude-file but ignores casing of `file`names in patterns")
 	f.StringVar(&rewriteOptions.ExcludeLargerThan, "exclude-larger-than", "", "max `size` of the files to keep in snapshot (allowed suffixes: k/K, m/M, g/G, t/T)")
+	f.StringArrayVar(&rewriteOptions.Renames, "rename", nil, "rename a `path`, format OLD=NEW, OLD may contain glob patterns (can be specified multiple times)")
+
+	f.StringArrayVar(&rewriteOptions.Includes, "include", nil, "only keep a `pattern` (can be specified multiple times)")
+	f.StringArrayVar(&rewriteOptions.InsensitiveIncludes, "iinclude", nil, "same as --include `pattern` but ignores the casing of filenames")
+	f.StringArrayVar(&rewriteOptions.IncludeFiles, "include-file", nil, "read include patterns from a `file` (can be specified multiple times)")
+	f.StringVar(&rewriteOptions.Filter, "filter", "", "exclude nodes matching the boolean `expression` over path, size, mtime, uid, gid and type")
+
+	f.IntVar(&rewriteOptions.Concurrency, "rewrite-concurrency", runtime.GOMAXPROCS(0), "number of `workers` used to rewrite subtrees concurrently")
 
 	f.StringArrayVarP(&rewriteOptions.Hosts, "host", "H", nil, "only consider snapshots for this `host`, when no snapshot ID is given (can be specified multiple times)")
 	f.Var(&rewriteOptions.Tags, "tag", "only consider snapshots which include this `taglist`, when no snapshot-ID is given")
@@ -90,66 +148,545 @@ type (
 	rejectFunction   = func(string, *restic.Node) bool
 )
 
+// renameRule describes a single --rename OLD=NEW pair. From may contain the
+// same glob patterns accepted by --exclude.
+type renameRule struct {
+	From string
+	To   string
+}
+
+// parseRenames turns the raw --rename values into renameRules, validating
+// that both sides are absolute, cleaned paths.
+func parseRenames(specs []string) ([]renameRule, error) {
+	rules := make([]renameRule, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Fatalf("invalid --rename value %q, expected the format OLD=NEW", spec)
+		}
+
+		from, to := path.Clean(parts[0]), path.Clean(parts[1])
+		if !path.IsAbs(from) || !path.IsAbs(to) {
+			return nil, errors.Fatalf("invalid --rename value %q, OLD and NEW must be absolute paths", spec)
+		}
+
+		rules = append(rules, renameRule{From: from, To: to})
+	}
+
+	return rules, nil
+}
+
+// matchRenameRoot reports whether p is itself the root of a rename, i.e. the
+// node renames apply to as a whole, and if so the path it is moved to. Only
+// the node whose path matches OLD is considered; its descendants are not
+// matched individually; they move along with it, keeping their paths
+// relative to it unchanged. Rules are tried in the order they were given on
+// the command line.
+func matchRenameRoot(p string, renames []renameRule) (string, bool) {
+	for _, r := range renames {
+		if p == r.From {
+			return r.To, true
+		}
+
+		if matched, err := filter.Match(r.From, p); err == nil && matched {
+			// filter.Match also matches every path below a matching one, so
+			// p is only the root of the rename if its parent does not match
+			if parentMatched, err := filter.Match(r.From, path.Dir(p)); err == nil && parentMatched {
+				continue
+			}
+
+			return r.To, true
+		}
+	}
+
+	return p, false
+}
+
+// pendingMove is a subtree (or leaf) cut out of its original location by a
+// matching --rename rule while the tree is traversed top-down. Moves are
+// collected up to rewriteSnapshot and grafted onto the snapshot's root tree
+// only once the whole snapshot has been filtered, so that a rename can
+// relocate a node anywhere in the snapshot, not just underneath whichever
+// directory happened to be open when the match was found.
+type pendingMove struct {
+	newPath string
+	node    restic.Node
+}
+
+// graftMove inserts node at newPath (an absolute path from the snapshot
+// root) into the tree identified by rootID, creating or reusing whichever
+// intermediate directories newPath requires, and returns the ID of the
+// resulting root tree. An existing entry at newPath is replaced, matching
+// the move semantics of --rename.
+func graftMove(ctx context.Context, repo restic.Repository, saveTreeFunc saveTreeFunction, rootID restic.ID, newPath string, node restic.Node) (restic.ID, error) {
+	segments := strings.Split(strings.Trim(newPath, "/"), "/")
+
+	return graftAt(ctx, repo, saveTreeFunc, &rootID, segments, node)
+}
+
+// graftAt is the recursive implementation of graftMove. treeID is nil for a
+// directory that does not exist yet and must be synthesized.
+func graftAt(ctx context.Context, repo restic.Repository, saveTreeFunc saveTreeFunction, treeID *restic.ID, segments []string, node restic.Node) (restic.ID, error) {
+	var nodes []*restic.Node
+	if treeID != nil {
+		tree, err := repo.LoadTree(ctx, *treeID)
+		if err != nil {
+			return restic.ID{}, err
+		}
+		nodes = tree.Nodes
+	}
+
+	name := segments[0]
+	newTree := restic.NewTree(len(nodes) + 1)
+	inserted := false
+
+	for _, n := range nodes {
+		if n.Name != name {
+			_ = newTree.Insert(n)
+			continue
+		}
+
+		inserted = true
+		if len(segments) == 1 {
+			leaf := node
+			leaf.Name = name
+			_ = newTree.Insert(&leaf)
+			continue
+		}
+
+		if n.Type != "dir" || n.Subtree == nil {
+			return restic.ID{}, errors.Errorf("cannot rename to %q: %q already exists and is not a directory", path.Join(append([]string{"/"}, segments...)...), name)
+		}
+
+		childID, err := graftAt(ctx, repo, saveTreeFunc, n.Subtree, segments[1:], node)
+		if err != nil {
+			return restic.ID{}, err
+		}
+
+		updated := *n
+		updated.Subtree = &childID
+		_ = newTree.Insert(&updated)
+	}
+
+	if !inserted {
+		if len(segments) == 1 {
+			leaf := node
+			leaf.Name = name
+			_ = newTree.Insert(&leaf)
+		} else {
+			childID, err := graftAt(ctx, repo, saveTreeFunc, nil, segments[1:], node)
+			if err != nil {
+				return restic.ID{}, err
+			}
+
+			_ = newTree.Insert(&restic.Node{
+				Name:    name,
+				Type:    "dir",
+				Mode:    os.ModeDir | 0755,
+				Subtree: &childID,
+			})
+		}
+	}
+
+	return saveTreeFunc(ctx, newTree)
+}
+
+// subtreeCacheKey identifies a memoized filterNode result. nodeID and
+// fingerprint alone are not enough: tree IDs are content hashes of the
+// node list, so two directories with identical contents but different
+// absolute paths (empty directories, vendored trees, or the very same
+// directory seen at an old and a new --rename mount point) hash to the
+// same nodeID. Since exclude/include/rename/filter rules can be anchored
+// to a path, reusing a result computed for one path at another would
+// silently apply that path's decisions to the wrong location. path pins
+// the cache to the exact location the subtree was found at, so only a
+// subtree seen again at that same path (typically the same, unmodified
+// directory across several snapshots) is served from cache.
+type subtreeCacheKey struct {
+	nodeID      restic.ID
+	path        string
+	fingerprint string
+}
+
+// subtreeCacheValue is what gets memoized per subtree: its rewritten ID, and
+// any pendingMoves cut out of it by a --rename rule. The moves are specific
+// to wherever this subtree is grafted into a given snapshot's tree, so they
+// are replayed on every cache hit, not just computed once.
+type subtreeCacheValue struct {
+	id    restic.ID
+	moves []pendingMove
+}
+
+type subtreeCacheEntry struct {
+	key   subtreeCacheKey
+	value subtreeCacheValue
+}
+
+// subtreeCache is a size-bounded, concurrency-safe LRU cache mapping
+// subtreeCacheKey to the rewritten tree ID, so that subtrees shared between
+// snapshots are only rewritten (and saved) once per run.
+type subtreeCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[subtreeCacheKey]*list.Element
+}
+
+func newSubtreeCache(capacity int) *subtreeCache {
+	return &subtreeCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[subtreeCacheKey]*list.Element),
+	}
+}
+
+func (c *subtreeCache) get(key subtreeCacheKey) (subtreeCacheValue, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return subtreeCacheValue{}, false
+	}
+
+	c.ll.MoveToFront(el)
+
+	return el.Value.(*subtreeCacheEntry).value, true
+}
+
+func (c *subtreeCache) add(key subtreeCacheKey, value subtreeCacheValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*subtreeCacheEntry).value = value
+
+		return
+	}
+
+	el := c.ll.PushFront(&subtreeCacheEntry{key: key, value: value})
+	c.items[key] = el
+
+	if c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*subtreeCacheEntry).key)
+	}
+}
+
+// subtreeCacheCapacity bounds the memory used by the subtree memoization
+// cache; it is generous enough to cache every unique subtree of most
+// repositories for the lifetime of a single rewrite run.
+const subtreeCacheCapacity = 200_000
+
+// rewriteFingerprint summarizes the exclude/include/filter/rename
+// configuration of a rewrite run, so that subtreeCache entries from runs (or
+// hypothetically, configurations) that filter nodes differently never
+// collide.
+func rewriteFingerprint(opts RewriteOptions) string {
+	h := sha256.New()
+	for _, patterns := range [][]string{
+		opts.Excludes, opts.InsensitiveExcludes, opts.ExcludeFiles, opts.InsensitiveExcludeFiles,
+		opts.Includes, opts.InsensitiveIncludes, opts.IncludeFiles, opts.Renames,
+	} {
+		for _, p := range patterns {
+			_, _ = io.WriteString(h, p)
+			_, _ = h.Write([]byte{0})
+		}
+		_, _ = h.Write([]byte{0})
+	}
+
+	_, _ = io.WriteString(h, opts.ExcludeLargerThan)
+	_, _ = h.Write([]byte{0})
+	_, _ = io.WriteString(h, opts.Filter)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// rewriteJSONWriter serializes the NDJSON events emitted by a --json rewrite
+// run. filterNode may call emit from several goroutines at once, so writes
+// are serialized with a mutex.
+type rewriteJSONWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newRewriteJSONWriter(wr io.Writer) *rewriteJSONWriter {
+	return &rewriteJSONWriter{enc: json.NewEncoder(wr)}
+}
+
+func (w *rewriteJSONWriter) emit(v interface{}) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_ = w.enc.Encode(v)
+}
+
+type jsonSnapshotChecked struct {
+	MessageType string `json:"message_type"` // "snapshot_checked"
+	SnapshotID  string `json:"snapshot_id"`
+}
+
+type jsonNodeExcluded struct {
+	MessageType string `json:"message_type"` // "node_excluded"
+	SnapshotID  string `json:"snapshot_id"`
+	Path        string `json:"path"`
+	Size        uint64 `json:"size"`
+}
+
+type jsonTreeRewritten struct {
+	MessageType string `json:"message_type"` // "tree_rewritten"
+	SnapshotID  string `json:"snapshot_id"`
+	Path        string `json:"path"`
+	OldTreeID   string `json:"old_tree_id"`
+	NewTreeID   string `json:"new_tree_id"`
+}
+
+type jsonSnapshotSaved struct {
+	MessageType   string `json:"message_type"` // "snapshot_saved"
+	OldSnapshotID string `json:"old_snapshot_id"`
+	NewSnapshotID string `json:"new_snapshot_id"`
+}
+
+type jsonSnapshotForgotten struct {
+	MessageType string `json:"message_type"` // "snapshot_forgotten"
+	SnapshotID  string `json:"snapshot_id"`
+}
+
+type jsonSummary struct {
+	MessageType        string `json:"message_type"` // "summary"
+	SnapshotsChecked   int    `json:"snapshots_checked"`
+	SnapshotsModified  int    `json:"snapshots_modified"`
+	SnapshotsForgotten int    `json:"snapshots_forgotten"`
+	NodesExcluded      int64  `json:"nodes_excluded"`
+	// LogicalBytesExcluded is the sum of Size across every excluded node. It
+	// is not an estimate of repository space that will actually be freed:
+	// excluded data can still be referenced by blobs that other, kept nodes
+	// share with it, and this field is computed without ever consulting
+	// repo.Index() to check. Use `restic prune` to find out what is actually
+	// reclaimable.
+	LogicalBytesExcluded uint64 `json:"logical_bytes_excluded"`
+}
+
+// rewriteWorkers bundles the state that is shared across all filterNode
+// calls of a single rewrite run: --rewrite-concurrency itself, the subtree
+// memoization cache, its fingerprint, a semaphore bounding how many
+// LoadTree/SaveTree calls are in flight at once, and (in --json mode) the
+// event writer and running totals for the final summary. The semaphore is
+// acquired only around those I/O calls, never across a whole recursive
+// filterNode call, so a goroutine waiting on its children never holds a
+// slot they themselves need; concurrency is what bounds the number of
+// sibling subtrees filterNode actually processes at once (via
+// errgroup.Group.SetLimit), so a single directory with hundreds of
+// thousands of entries doesn't spawn a goroutine per entry.
+type rewriteWorkers struct {
+	sem         chan struct{}
+	concurrency int
+	cache       *subtreeCache
+	fingerprint string
+
+	json                 *rewriteJSONWriter
+	nodesExcluded        int64
+	logicalBytesExcluded uint64
+}
+
+// recordExcluded updates the running summary counters for an excluded node
+// and, in --json mode, emits a node_excluded event for it. logicalBytesExcluded
+// only tallies node.Size; it is not index-aware, so it does not account for
+// data the excluded node shares with blobs still referenced elsewhere.
+func (rw *rewriteWorkers) recordExcluded(snapshotID string, nodepath string, node *restic.Node) {
+	atomic.AddInt64(&rw.nodesExcluded, 1)
+	atomic.AddUint64(&rw.logicalBytesExcluded, node.Size)
+	rw.json.emit(jsonNodeExcluded{MessageType: "node_excluded", SnapshotID: snapshotID, Path: nodepath, Size: node.Size})
+}
+
+// filterNode rewrites the subtree rooted at nodeID, which lives at nodepath,
+// applying excludes and cutting out any node that is the root of a
+// --rename rule. It returns the rewritten tree's ID together with the
+// pendingMoves cut out of it (including those bubbled up from nested
+// subtrees); renames are not applied in place here, since the destination
+// may lie anywhere in the snapshot, not just underneath nodepath. Applying
+// them is left to rewriteSnapshot, which grafts every pendingMove onto the
+// snapshot's root tree once the whole snapshot has been filtered.
 func filterNode(ctx context.Context, repo restic.Repository, nodepath string, nodeID restic.ID,
-	checkExclude rejectFunction, saveTreeFunc saveTreeFunction) (restic.ID, error) {
+	checkExclude rejectFunction, renames []renameRule, saveTreeFunc saveTreeFunction, rw *rewriteWorkers, snapshotID string) (restic.ID, []pendingMove, error) {
+	cacheKey := subtreeCacheKey{nodeID: nodeID, path: nodepath, fingerprint: rw.fingerprint}
+	if cached, ok := rw.cache.get(cacheKey); ok {
+		debug.Log("filterNode: cache hit for %s, nodeId: %s\n", nodepath, nodeID.Str())
+
+		return cached.id, cached.moves, nil
+	}
+
+	rw.sem <- struct{}{}
 	curTree, err := repo.LoadTree(ctx, nodeID)
+	<-rw.sem
 	if err != nil {
-		return nodeID, err
+		return nodeID, nil, err
 	}
 
 	debug.Log("filterNode: %s, nodeId: %s\n", nodepath, nodeID.Str())
 
-	changed := false
-	newTree := restic.NewTree(len(curTree.Nodes))
-	for _, node := range curTree.Nodes {
-		path := path.Join(nodepath, node.Name)
-		if !checkExclude(path, node) {
-			if node.Subtree == nil {
-				_ = newTree.Insert(node)
+	// one slot per node of curTree, filled in either directly below (leaves,
+	// excludes, renames) or by a worker goroutine (subtrees)
+	type nodeResult struct {
+		excluded bool
+		changed  bool
+		node     *restic.Node
+		moves    []pendingMove
+	}
+
+	results := make([]nodeResult, len(curTree.Nodes))
+
+	g, gctx := errgroup.WithContext(ctx)
+	// bounds how many of curTree's children are processed concurrently; without
+	// it a single wide directory spawns one goroutine per entry regardless of
+	// --rewrite-concurrency
+	g.SetLimit(rw.concurrency)
+	for i, node := range curTree.Nodes {
+		nodePath := path.Join(nodepath, node.Name)
+
+		if checkExclude(nodePath, node) {
+			if rw.json == nil {
+				Verboseff("excluding %s\n", nodePath)
+			}
+			rw.recordExcluded(snapshotID, nodePath, node)
+			results[i] = nodeResult{excluded: true}
+
+			continue
+		}
+
+		newPath, renamed := matchRenameRoot(nodePath, renames)
+		if renamed && rw.json == nil {
+			Verboseff("renaming %s to %s\n", nodePath, newPath)
+		}
+
+		if node.Subtree == nil {
+			if !renamed {
+				results[i] = nodeResult{node: node}
 
 				continue
 			}
-			newNode := node
-			newID, err := filterNode(ctx, repo, path, *node.Subtree, checkExclude, saveTreeFunc)
+
+			results[i] = nodeResult{excluded: true, moves: []pendingMove{{newPath: newPath, node: *node}}}
+
+			continue
+		}
+
+		i, node, newPath, renamed := i, node, newPath, renamed
+		g.Go(func() error {
+			// filterNode acquires rw.sem itself, only around its own
+			// LoadTree/SaveTree calls, so we must not hold a slot here while
+			// waiting on it: a slot held across this call would also be held
+			// across that call's own g.Wait() for its children, who need the
+			// same semaphore to make progress, deadlocking once the tree is
+			// nested deeper than --rewrite-concurrency.
+			newID, childMoves, err := filterNode(gctx, repo, nodePath, *node.Subtree, checkExclude, renames, saveTreeFunc, rw, snapshotID)
 			if err != nil {
-				return nodeID, err
+				return err
 			}
-			if newID == *node.Subtree {
-				_ = newTree.Insert(node)
-			} else {
-				changed = true
-				newNode.Subtree = new(restic.ID)
-				*newNode.Subtree = newID
-				_ = newTree.Insert(newNode)
+
+			if !renamed {
+				if newID == *node.Subtree {
+					results[i] = nodeResult{node: node, moves: childMoves}
+
+					return nil
+				}
+
+				changedNode := *node
+				changedNode.Subtree = new(restic.ID)
+				*changedNode.Subtree = newID
+				results[i] = nodeResult{changed: true, node: &changedNode, moves: childMoves}
+
+				return nil
 			}
-		} else {
-			Verboseff("excluding %s\n", path)
+
+			// node itself is the root of a rename: cut it out of this tree
+			// (after filtering its contents) and carry it, along with any
+			// moves already bubbled up from inside it, up to rewriteSnapshot
+			movedNode := *node
+			movedNode.Subtree = new(restic.ID)
+			*movedNode.Subtree = newID
+			moves := append([]pendingMove{{newPath: newPath, node: movedNode}}, childMoves...)
+			results[i] = nodeResult{excluded: true, moves: moves}
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nodeID, nil, err
+	}
+
+	changed := false
+	var moves []pendingMove
+	newTree := restic.NewTree(len(curTree.Nodes))
+	for _, r := range results {
+		moves = append(moves, r.moves...)
+
+		if r.excluded {
 			changed = true
+			continue
 		}
+
+		changed = changed || r.changed
+		_ = newTree.Insert(r.node)
 	}
 
-	if changed {
-		// save new tree
-		newTreeID, err := saveTreeFunc(ctx, newTree)
-		debug.Log("filterNode: save new tree for %s as %v\n", nodepath, newTreeID)
+	if !changed {
+		rw.cache.add(cacheKey, subtreeCacheValue{id: nodeID, moves: moves})
 
-		return newTreeID, err
+		return nodeID, moves, nil
 	}
 
-	return nodeID, nil
+	// save new tree
+	rw.sem <- struct{}{}
+	newTreeID, err := saveTreeFunc(ctx, newTree)
+	<-rw.sem
+	if err != nil {
+		return nodeID, nil, err
+	}
+
+	debug.Log("filterNode: save new tree for %s as %v\n", nodepath, newTreeID)
+	rw.cache.add(cacheKey, subtreeCacheValue{id: newTreeID, moves: moves})
+	rw.json.emit(jsonTreeRewritten{
+		MessageType: "tree_rewritten",
+		SnapshotID:  snapshotID,
+		Path:        nodepath,
+		OldTreeID:   nodeID.String(),
+		NewTreeID:   newTreeID.String(),
+	})
+
+	return newTreeID, moves, nil
 }
 
 func rewriteSnapshot(ctx context.Context, repo *repository.Repository, sn *restic.Snapshot, addTags restic.TagList,
-	checkExclude rejectFunction, saveTreeFunc saveTreeFunction) (*restic.Snapshot, error) {
+	checkExclude rejectFunction, renames []renameRule, saveTreeFunc saveTreeFunction, rw *rewriteWorkers, dryRun bool) (*restic.Snapshot, error) {
 	if sn.Tree == nil {
 		return nil, errors.Errorf("snapshot %v has nil tree", sn.ID())
 	}
 
-	filteredTree, err := filterNode(ctx, repo, "/", *sn.Tree, checkExclude, saveTreeFunc)
+	filteredTree, moves, err := filterNode(ctx, repo, "/", *sn.Tree, checkExclude, renames, saveTreeFunc, rw, sn.ID().String())
 	if err != nil {
 		return nil, err
 	}
 
+	// In dry-run mode saveTreeFunc is a stub that always returns the zero
+	// ID, so filteredTree is not a real tree we could load and graft onto;
+	// any move already made filteredTree differ from *sn.Tree above, which
+	// is all dry-run mode needs to report the snapshot as modified.
+	if !dryRun {
+		for _, mv := range moves {
+			filteredTree, err = graftMove(ctx, repo, saveTreeFunc, filteredTree, mv.newPath, mv.node)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	if filteredTree == *sn.Tree {
 		debug.Log("snapshot not touched\n")
 
@@ -199,6 +736,85 @@ func collectRejectByNameFuncsForRewrite(opts RewriteOptions) (fs []RejectByNameF
 		fs = append(fs, rejectByPattern(opts.Excludes))
 	}
 
+	// includes are evaluated after excludes and invert the match: an item
+	// that does not match any include pattern is rejected
+	if len(opts.IncludeFiles) > 0 {
+		includes, err := readExcludePatternsFromFiles(opts.IncludeFiles)
+		if err != nil {
+			return nil, err
+		}
+		opts.Includes = append(opts.Includes, includes...)
+	}
+
+	// an item is kept if it matches at least one --include or --iinclude
+	// pattern
+	if len(opts.Includes) > 0 || len(opts.InsensitiveIncludes) > 0 {
+		rejectSensitive := rejectIfNotPattern(opts.Includes)
+		rejectInsensitive := rejectIfNotInsensitivePattern(opts.InsensitiveIncludes)
+		fs = append(fs, func(nodepath string) bool {
+			return rejectSensitive(nodepath) && rejectInsensitive(nodepath)
+		})
+	}
+
+	return fs, nil
+}
+
+// rejectIfNotPattern rejects any path that does not match at least one of
+// the given patterns.
+func rejectIfNotPattern(patterns []string) RejectByNameFunc {
+	return func(nodepath string) bool {
+		for _, pat := range patterns {
+			if matched, err := filter.Match(pat, nodepath); err == nil && matched {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// rejectIfNotInsensitivePattern is rejectIfNotPattern, but ignores the
+// casing of nodepath.
+func rejectIfNotInsensitivePattern(patterns []string) RejectByNameFunc {
+	lowerPatterns := make([]string, len(patterns))
+	for i, pat := range patterns {
+		lowerPatterns[i] = strings.ToLower(pat)
+	}
+
+	return func(nodepath string) bool {
+		return rejectIfNotPattern(lowerPatterns)(strings.ToLower(nodepath))
+	}
+}
+
+// collectFilterRejectFuncsForRewrite parses opts.Filter, if set, into a
+// rejectFunction that excludes every node the expression matches.
+//
+// internal/filter is intentionally independent of this file: ParseExpr and
+// Expr.Match only depend on filter.Attrs, so a backup command could build
+// the same rejectFunction shape from its own node representation and get
+// --filter support for free. The backup command does not use it; only
+// rewrite accepts --filter.
+func collectFilterRejectFuncsForRewrite(opts RewriteOptions) (fs []rejectFunction, err error) {
+	if opts.Filter == "" {
+		return nil, nil
+	}
+
+	expr, err := filter.ParseExpr(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	fs = append(fs, func(nodepath string, node *restic.Node) bool {
+		return expr.Match(filter.Attrs{
+			Path:    nodepath,
+			Size:    node.Size,
+			ModTime: node.ModTime,
+			UID:     node.UID,
+			GID:     node.GID,
+			Type:    string(node.Type),
+		})
+	})
+
 	return fs, nil
 }
 
@@ -246,8 +862,10 @@ func runRewrite(opts RewriteOptions, gopts GlobalOptions, args []string) error {
 	}
 	if len(opts.Excludes) == 0 && len(opts.InsensitiveExcludes) == 0 &&
 		len(opts.ExcludeFiles) == 0 && len(opts.InsensitiveExcludeFiles) == 0 &&
-		opts.ExcludeLargerThan == "" {
-		return errors.Fatal("Nothing to do: no excludes provided")
+		opts.ExcludeLargerThan == "" && len(opts.Renames) == 0 &&
+		len(opts.Includes) == 0 && len(opts.InsensitiveIncludes) == 0 &&
+		len(opts.IncludeFiles) == 0 && opts.Filter == "" {
+		return errors.Fatal("Nothing to do: no excludes, includes, filter or renames provided")
 	}
 	if !opts.DryRun && !opts.Forget && len(opts.AddTags) == 0 {
 		opts.DryRun = true
@@ -264,6 +882,31 @@ func runRewrite(opts RewriteOptions, gopts GlobalOptions, args []string) error {
 		return err
 	}
 
+	filterRejectFuncs, err := collectFilterRejectFuncsForRewrite(opts)
+	if err != nil {
+		return err
+	}
+
+	renames, err := parseRenames(opts.Renames)
+	if err != nil {
+		return err
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	rw := &rewriteWorkers{
+		sem:         make(chan struct{}, concurrency),
+		concurrency: concurrency,
+		cache:       newSubtreeCache(subtreeCacheCapacity),
+		fingerprint: rewriteFingerprint(opts),
+	}
+	if gopts.JSON {
+		rw.json = newRewriteJSONWriter(gopts.stdout)
+	}
+
 	checkExclude := func(nodepath string, node *restic.Node) bool {
 		for _, reject := range rejectByNameFuncs {
 			if reject(nodepath) {
@@ -277,6 +920,12 @@ func runRewrite(opts RewriteOptions, gopts GlobalOptions, args []string) error {
 			}
 		}
 
+		for _, reject := range filterRejectFuncs {
+			if reject(nodepath, node) {
+				return true
+			}
+		}
+
 		return false
 	}
 
@@ -313,28 +962,55 @@ func runRewrite(opts RewriteOptions, gopts GlobalOptions, args []string) error {
 		newSn   *restic.Snapshot
 		oldSnID *restic.ID
 	}
-	var changed []changedSnaphot
+
+	snapshotsChecked := 0
+	snapshotsForgotten := 0
+	var changedSnaphots []changedSnaphot
+	emitSummary := func() {
+		rw.json.emit(jsonSummary{
+			MessageType:          "summary",
+			SnapshotsChecked:     snapshotsChecked,
+			SnapshotsModified:    len(changedSnaphots),
+			SnapshotsForgotten:   snapshotsForgotten,
+			NodesExcluded:        atomic.LoadInt64(&rw.nodesExcluded),
+			LogicalBytesExcluded: atomic.LoadUint64(&rw.logicalBytesExcluded),
+		})
+	}
+
 	for sn := range FindFilteredSnapshots(ctx, repo, opts.Hosts, opts.Tags, opts.Paths, args) {
-		if opts.Compact {
+		snapshotsChecked++
+		if rw.json != nil {
+			rw.json.emit(jsonSnapshotChecked{MessageType: "snapshot_checked", SnapshotID: sn.ID().String()})
+		} else if opts.Compact {
 			Verbosef("checking snapshot %s\n", sn.ID().Str())
 		} else {
 			Verbosef("checking snapshot %s\n", sn.String())
 		}
-		if newsn, err := rewriteSnapshot(ctx, repo, sn, opts.AddTags, checkExclude, saveTreeFunc); err != nil {
+		if newsn, err := rewriteSnapshot(ctx, repo, sn, opts.AddTags, checkExclude, renames, saveTreeFunc, rw, opts.DryRun); err != nil {
 			Warnf("unable to rewrite snapshot %s, ignoring: %v\n", sn.ID().Str(), err)
 		} else if newsn != nil {
-			Verbosef("snapshot %s modified\n", sn.ID().Str())
-			changed = append(changed, changedSnaphot{newsn, sn.ID()})
+			if rw.json == nil {
+				Verbosef("snapshot %s modified\n", sn.ID().Str())
+			}
+			changedSnaphots = append(changedSnaphots, changedSnaphot{newsn, sn.ID()})
 		}
 	}
 
-	if len(changed) == 0 {
-		Verbosef("no snapshots modified\n")
+	if len(changedSnaphots) == 0 {
+		if rw.json != nil {
+			emitSummary()
+		} else {
+			Verbosef("no snapshots modified\n")
+		}
 
 		return nil
 	}
 	if opts.DryRun {
-		Verbosef("would have modified %d snapshots\n", len(changed))
+		if rw.json != nil {
+			emitSummary()
+		} else {
+			Verbosef("would have modified %d snapshots\n", len(changedSnaphots))
+		}
 
 		return nil
 	}
@@ -344,17 +1020,25 @@ func runRewrite(opts RewriteOptions, gopts GlobalOptions, args []string) error {
 	}
 
 	// save the new snapshots
-	Verbosef("will save %d new snapshots\n", len(changed))
-	removeSnIDs := make([]string, 0, len(changed))
-	for _, sn := range changed {
+	if rw.json == nil {
+		Verbosef("will save %d new snapshots\n", len(changedSnaphots))
+	}
+	removeSnIDs := make([]string, 0, len(changedSnaphots))
+	for _, sn := range changedSnaphots {
 		id, err := repo.SaveJSONUnpacked(ctx, restic.SnapshotFile, sn.newSn)
 		if err != nil {
 			return err
 		}
-		Verboseff("snapshot %s saved as %s\n", sn.oldSnID.Str(), id.Str())
+		if rw.json != nil {
+			rw.json.emit(jsonSnapshotSaved{MessageType: "snapshot_saved", OldSnapshotID: sn.oldSnID.String(), NewSnapshotID: id.String()})
+		} else {
+			Verboseff("snapshot %s saved as %s\n", sn.oldSnID.Str(), id.Str())
+		}
 		removeSnIDs = append(removeSnIDs, sn.oldSnID.String())
 	}
-	Verbosef("modified %d snapshots\n", len(changed))
+	if rw.json == nil {
+		Verbosef("modified %d snapshots\n", len(changedSnaphots))
+	}
 
 	// call 'forget' command
 	if !opts.DryRun && opts.Forget && len(removeSnIDs) > 0 {
@@ -363,6 +1047,15 @@ func runRewrite(opts RewriteOptions, gopts GlobalOptions, args []string) error {
 		if err := runForgetWithRepo(forgetOptions, gopts, removeSnIDs, repo); err != nil {
 			return err
 		}
+
+		snapshotsForgotten = len(removeSnIDs)
+		for _, id := range removeSnIDs {
+			rw.json.emit(jsonSnapshotForgotten{MessageType: "snapshot_forgotten", SnapshotID: id})
+		}
+	}
+
+	if rw.json != nil {
+		emitSummary()
 	}
 
 	return nil
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/internal/restic"
+)
+
+// fakeRepo is a minimal restic.Repository that only implements the methods
+// filterNode and graftAt actually call. Every other method is promoted from
+// the nil embedded interface and panics if invoked, which is deliberate: a
+// test that starts calling those has outgrown what this fake can stand in
+// for.
+type fakeRepo struct {
+	restic.Repository
+
+	mu    sync.Mutex
+	trees map[restic.ID]*restic.Tree
+	next  byte
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{trees: make(map[restic.ID]*restic.Tree)}
+}
+
+func (f *fakeRepo) LoadTree(_ context.Context, id restic.ID) (*restic.Tree, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tree, ok := f.trees[id]
+	if !ok {
+		return nil, fmt.Errorf("fakeRepo: no such tree %s", id)
+	}
+
+	return tree, nil
+}
+
+func (f *fakeRepo) SaveTree(_ context.Context, tree *restic.Tree) (restic.ID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.next++
+	id := restic.ID{f.next}
+	f.trees[id] = tree
+
+	return id, nil
+}
+
+func (f *fakeRepo) put(tree *restic.Tree) restic.ID {
+	id, _ := f.SaveTree(context.Background(), tree)
+
+	return id
+}
+
+// countingRepo wraps a fakeRepo to track how many LoadTree calls are in
+// flight at once, so a test can assert that filterNode's fan-out is actually
+// bounded by rewriteWorkers.concurrency rather than by the curTree.Nodes
+// length.
+type countingRepo struct {
+	*fakeRepo
+
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (c *countingRepo) LoadTree(ctx context.Context, id restic.ID) (*restic.Tree, error) {
+	c.mu.Lock()
+	c.active++
+	if c.active > c.maxSeen {
+		c.maxSeen = c.active
+	}
+	c.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	tree, err := c.fakeRepo.LoadTree(ctx, id)
+
+	c.mu.Lock()
+	c.active--
+	c.mu.Unlock()
+
+	return tree, err
+}
+
+func dirNode(name string, subtree restic.ID) *restic.Node {
+	return &restic.Node{Name: name, Type: "dir", Subtree: &subtree}
+}
+
+func fileNode(name string) *restic.Node {
+	return &restic.Node{Name: name, Type: "file"}
+}
+
+// TestFilterNodeDeepChainNoDeadlock guards against the deadlock fixed in
+// filterNode: rw.sem used to be held by a goroutine for the whole duration
+// of its recursive filterNode call, including that call's own g.Wait() for
+// its children, who need the same semaphore. A single-child directory chain
+// deeper than --rewrite-concurrency reproduced it reliably.
+func TestFilterNodeDeepChainNoDeadlock(t *testing.T) {
+	repo := newFakeRepo()
+
+	const depth = 6
+	const concurrency = 1 // smaller than depth: the condition the bug needed
+
+	leaf := restic.NewTree(1)
+	_ = leaf.Insert(fileNode("leaf"))
+	id := repo.put(leaf)
+
+	for i := 0; i < depth; i++ {
+		tree := restic.NewTree(1)
+		_ = tree.Insert(dirNode(fmt.Sprintf("d%d", i), id))
+		id = repo.put(tree)
+	}
+
+	rw := &rewriteWorkers{
+		sem:         make(chan struct{}, concurrency),
+		concurrency: concurrency,
+		cache:       newSubtreeCache(subtreeCacheCapacity),
+		fingerprint: "test",
+	}
+
+	checkExclude := func(string, *restic.Node) bool { return false }
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := filterNode(context.Background(), repo, "/", id, checkExclude, nil, repo.SaveTree, rw, "snap")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("filterNode returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("filterNode did not complete within 2s, likely deadlocked on rw.sem")
+	}
+}
+
+func TestSubtreeCacheLRUEviction(t *testing.T) {
+	c := newSubtreeCache(2)
+
+	k1 := subtreeCacheKey{nodeID: restic.ID{1}, fingerprint: "f"}
+	k2 := subtreeCacheKey{nodeID: restic.ID{2}, fingerprint: "f"}
+	k3 := subtreeCacheKey{nodeID: restic.ID{3}, fingerprint: "f"}
+
+	c.add(k1, subtreeCacheValue{id: restic.ID{11}})
+	c.add(k2, subtreeCacheValue{id: restic.ID{12}})
+
+	if _, ok := c.get(k1); !ok {
+		t.Fatal("expected k1 to be cached")
+	}
+
+	// k1 was just touched by get, so k2 is now the least recently used and
+	// gets evicted once a third entry pushes the cache over capacity
+	c.add(k3, subtreeCacheValue{id: restic.ID{13}})
+
+	if _, ok := c.get(k2); ok {
+		t.Error("expected k2 to have been evicted")
+	}
+	if _, ok := c.get(k1); !ok {
+		t.Error("expected k1 to still be cached")
+	}
+	if _, ok := c.get(k3); !ok {
+		t.Error("expected k3 to be cached")
+	}
+}
+
+// TestFilterNodeCacheIsPathAnchored guards against the bug where the
+// subtree cache was keyed on {nodeID, fingerprint} alone: two directories
+// with byte-identical contents (same nodeID) but different absolute paths
+// would share a cached result, silently replaying the first path's
+// exclude/rename decisions at the second. Here /a/x and /b/x have
+// identical contents; --exclude /a/x must not also exclude /b/x.
+func TestFilterNodeCacheIsPathAnchored(t *testing.T) {
+	repo := newFakeRepo()
+
+	xContents := buildTree(t, repo, fileNode("keep.txt"))
+	aDirID := buildTree(t, repo, dirNode("x", xContents))
+	bDirID := buildTree(t, repo, dirNode("x", xContents))
+	rootID := buildTree(t, repo, dirNode("a", aDirID), dirNode("b", bDirID))
+
+	rw := &rewriteWorkers{
+		sem:         make(chan struct{}, 2),
+		concurrency: 2,
+		cache:       newSubtreeCache(subtreeCacheCapacity),
+		fingerprint: "test",
+	}
+
+	checkExclude := func(nodepath string, _ *restic.Node) bool {
+		return nodepath == "/a/x"
+	}
+
+	filteredID, _, err := filterNode(context.Background(), repo, "/", rootID, checkExclude, nil, repo.SaveTree, rw, "snap")
+	if err != nil {
+		t.Fatalf("filterNode: %v", err)
+	}
+
+	root := loadTree(t, repo, filteredID)
+	var aNode, bNode *restic.Node
+	for _, n := range root.Nodes {
+		switch n.Name {
+		case "a":
+			aNode = n
+		case "b":
+			bNode = n
+		}
+	}
+	if aNode == nil || bNode == nil {
+		t.Fatalf("expected both /a and /b to remain, got %v", nodeNames(root))
+	}
+
+	aTree := loadTree(t, repo, *aNode.Subtree)
+	if len(aTree.Nodes) != 0 {
+		t.Errorf("expected /a/x to have been excluded, found %v", nodeNames(aTree))
+	}
+
+	bTree := loadTree(t, repo, *bNode.Subtree)
+	if len(bTree.Nodes) != 1 || bTree.Nodes[0].Name != "x" {
+		t.Errorf("expected /b/x to survive untouched (it is not /a/x), got %v", nodeNames(bTree))
+	}
+}
+
+// TestFilterNodeBoundsFanOut guards against filterNode spawning one
+// goroutine per child node regardless of --rewrite-concurrency: a directory
+// with many subtrees used to fan out unbounded, so a single wide directory
+// (the "large repositories" case this flag targets) could spawn hundreds of
+// thousands of goroutines at once. g.SetLimit(rw.concurrency) should keep
+// the number of subtrees actually being loaded at once at or below
+// rw.concurrency.
+func TestFilterNodeBoundsFanOut(t *testing.T) {
+	const concurrency = 3
+	const numChildren = 12
+
+	repo := &countingRepo{fakeRepo: newFakeRepo()}
+
+	var children []*restic.Node
+	for i := 0; i < numChildren; i++ {
+		leaf := buildTree(t, repo.fakeRepo, fileNode("leaf"))
+		children = append(children, dirNode(fmt.Sprintf("d%d", i), leaf))
+	}
+	rootID := buildTree(t, repo.fakeRepo, children...)
+
+	rw := &rewriteWorkers{
+		sem:         make(chan struct{}, numChildren),
+		concurrency: concurrency,
+		cache:       newSubtreeCache(subtreeCacheCapacity),
+		fingerprint: "test",
+	}
+	checkExclude := func(string, *restic.Node) bool { return false }
+
+	_, _, err := filterNode(context.Background(), repo, "/", rootID, checkExclude, nil, repo.SaveTree, rw, "snap")
+	if err != nil {
+		t.Fatalf("filterNode: %v", err)
+	}
+
+	if repo.maxSeen > concurrency {
+		t.Errorf("saw %d concurrent LoadTree calls, want at most rw.concurrency=%d", repo.maxSeen, concurrency)
+	}
+	if repo.maxSeen < 2 {
+		t.Errorf("saw at most %d concurrent LoadTree call, expected some real parallelism up to %d", repo.maxSeen, concurrency)
+	}
+}
+
+func TestSubtreeCacheCarriesMoves(t *testing.T) {
+	c := newSubtreeCache(10)
+	key := subtreeCacheKey{nodeID: restic.ID{1}, fingerprint: "f"}
+
+	moves := []pendingMove{{newPath: "/new/path", node: restic.Node{Name: "x"}}}
+	c.add(key, subtreeCacheValue{id: restic.ID{2}, moves: moves})
+
+	got, ok := c.get(key)
+	if !ok {
+		t.Fatal("expected cache hit")
+	}
+	if len(got.moves) != 1 || got.moves[0].newPath != "/new/path" {
+		t.Errorf("cached moves not round-tripped correctly: %#v", got.moves)
+	}
+}
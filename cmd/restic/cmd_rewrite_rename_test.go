@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/restic/restic/internal/restic"
+)
+
+// buildTree saves a tree built from the given nodes and returns its ID.
+func buildTree(t *testing.T, repo *fakeRepo, nodes ...*restic.Node) restic.ID {
+	t.Helper()
+
+	tree := restic.NewTree(len(nodes))
+	for _, n := range nodes {
+		if err := tree.Insert(n); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+
+	return repo.put(tree)
+}
+
+func loadTree(t *testing.T, repo *fakeRepo, id restic.ID) *restic.Tree {
+	t.Helper()
+
+	tree, err := repo.LoadTree(context.Background(), id)
+	if err != nil {
+		t.Fatalf("LoadTree: %v", err)
+	}
+
+	return tree
+}
+
+func nodeNames(tree *restic.Tree) []string {
+	var names []string
+	for _, n := range tree.Nodes {
+		names = append(names, n.Name)
+	}
+
+	return names
+}
+
+// TestRenameRelocatesAcrossUnrelatedPrefix is the regression test for the
+// bug where --rename OLD=NEW nested the moved subtree underneath its
+// original location whenever NEW didn't share a prefix with the directory
+// enclosing OLD, e.g. --rename /srv/data=/backup/data ending up at
+// /srv/backup/data instead of /backup/data.
+func TestRenameRelocatesAcrossUnrelatedPrefix(t *testing.T) {
+	repo := newFakeRepo()
+
+	dataFile := buildTree(t, repo, fileNode("file.txt"))
+	dataDirID := buildTree(t, repo, dirNode("data", dataFile))
+	rootID := buildTree(t, repo, dirNode("srv", dataDirID))
+
+	renames, err := parseRenames([]string{"/srv/data=/backup/data"})
+	if err != nil {
+		t.Fatalf("parseRenames: %v", err)
+	}
+
+	rw := &rewriteWorkers{
+		sem:         make(chan struct{}, 2),
+		concurrency: 2,
+		cache:       newSubtreeCache(subtreeCacheCapacity),
+		fingerprint: "test",
+	}
+	checkExclude := func(string, *restic.Node) bool { return false }
+
+	filteredID, moves, err := filterNode(context.Background(), repo, "/", rootID, checkExclude, renames, repo.SaveTree, rw, "snap")
+	if err != nil {
+		t.Fatalf("filterNode: %v", err)
+	}
+	if len(moves) != 1 {
+		t.Fatalf("expected 1 pending move, got %d: %#v", len(moves), moves)
+	}
+	if moves[0].newPath != "/backup/data" {
+		t.Fatalf("pending move newPath = %q, want %q", moves[0].newPath, "/backup/data")
+	}
+
+	for _, mv := range moves {
+		filteredID, err = graftMove(context.Background(), repo, repo.SaveTree, filteredID, mv.newPath, mv.node)
+		if err != nil {
+			t.Fatalf("graftMove: %v", err)
+		}
+	}
+
+	root := loadTree(t, repo, filteredID)
+	if got := nodeNames(root); len(got) != 2 {
+		t.Fatalf("root tree has nodes %v, want [srv backup]-ish pair", got)
+	}
+
+	var srvNode, backupNode *restic.Node
+	for _, n := range root.Nodes {
+		switch n.Name {
+		case "srv":
+			srvNode = n
+		case "backup":
+			backupNode = n
+		}
+	}
+	if srvNode == nil || srvNode.Subtree == nil {
+		t.Fatalf("expected an srv directory to remain at the root")
+	}
+	if backupNode == nil || backupNode.Subtree == nil {
+		t.Fatalf("expected a backup directory to have been created at the root")
+	}
+
+	srvTree := loadTree(t, repo, *srvNode.Subtree)
+	if len(srvTree.Nodes) != 0 {
+		t.Fatalf("expected /srv to be emptied by the rename, found %v", nodeNames(srvTree))
+	}
+
+	backupTree := loadTree(t, repo, *backupNode.Subtree)
+	if names := nodeNames(backupTree); len(names) != 1 || names[0] != "data" {
+		t.Fatalf("expected /backup to contain exactly \"data\", got %v", names)
+	}
+
+	dataTree := loadTree(t, repo, *backupTree.Nodes[0].Subtree)
+	if names := nodeNames(dataTree); len(names) != 1 || names[0] != "file.txt" {
+		t.Fatalf("expected /backup/data to contain exactly \"file.txt\", got %v", names)
+	}
+}
+
+// TestGraftMoveIntoExistingDirectory checks that grafting a move onto a
+// destination directory that already has other content preserves that
+// content instead of replacing the whole directory.
+func TestGraftMoveIntoExistingDirectory(t *testing.T) {
+	repo := newFakeRepo()
+
+	backupContentsID := buildTree(t, repo, fileNode("keep.txt"))
+	rootID := buildTree(t, repo, dirNode("backup", backupContentsID))
+
+	moved := restic.Node{Name: "data", Type: "dir"}
+	newRootID, err := graftMove(context.Background(), repo, repo.SaveTree, rootID, "/backup/data", moved)
+	if err != nil {
+		t.Fatalf("graftMove: %v", err)
+	}
+
+	root := loadTree(t, repo, newRootID)
+	if len(root.Nodes) != 1 || root.Nodes[0].Name != "backup" {
+		t.Fatalf("unexpected root contents: %v", nodeNames(root))
+	}
+
+	backupTree := loadTree(t, repo, *root.Nodes[0].Subtree)
+	names := nodeNames(backupTree)
+	if len(names) != 2 {
+		t.Fatalf("expected /backup to contain both the pre-existing file and the grafted dir, got %v", names)
+	}
+}
@@ -0,0 +1,368 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attrs carries the node attributes an Expr can be evaluated against. It is
+// deliberately independent of restic.Node so that this package does not need
+// to import it.
+type Attrs struct {
+	Path    string
+	Size    uint64
+	ModTime time.Time
+	UID     uint32
+	GID     uint32
+	Type    string
+}
+
+// Expr is a parsed boolean filter expression, as accepted by the --filter
+// flag of the rewrite command, e.g.:
+//
+//	mtime < 2020-01-01 && size > 100M && !path matches "**/.cache/**"
+//
+// Evaluation only depends on Attrs, not on restic.Node or anything specific
+// to rewrite, so any other command that filters nodes (e.g. backup) can
+// reuse ParseExpr and Expr.Match as-is.
+//
+// An Expr matches an Attrs value if the expression evaluates to true for it.
+type Expr struct {
+	eval func(Attrs) bool
+}
+
+// Match reports whether attrs satisfies the expression.
+func (e *Expr) Match(attrs Attrs) bool {
+	return e.eval(attrs)
+}
+
+// ParseExpr parses a filter expression. The grammar is:
+//
+//	expr       = and ( "||" and )*
+//	and        = unary ( "&&" unary )*
+//	unary      = "!" unary | primary
+//	primary    = "(" expr ")" | comparison
+//	comparison = field op value
+//	field      = "path" | "size" | "mtime" | "uid" | "gid" | "type"
+//	op         = "==" | "!=" | "<" | "<=" | ">" | ">=" | "matches"
+func ParseExpr(s string) (*Expr, error) {
+	p := &exprParser{tokens: tokenize(s), src: s}
+	eval, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("filter expression %q: unexpected token %q", s, p.tokens[p.pos])
+	}
+
+	return &Expr{eval: eval}, nil
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+	src    string
+}
+
+func (p *exprParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() string {
+	tok := p.peek()
+	p.pos++
+
+	return tok
+}
+
+func (p *exprParser) parseOr() (func(Attrs) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "||" {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		r := right
+		left = func(a Attrs) bool { return l(a) || r(a) }
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (func(Attrs) bool, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "&&" {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		r := right
+		left = func(a Attrs) bool { return l(a) && r(a) }
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (func(Attrs) bool, error) {
+	if p.peek() == "!" {
+		p.next()
+
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(a Attrs) bool { return !inner(a) }, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (func(Attrs) bool, error) {
+	if p.peek() == "(" {
+		p.next()
+
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("filter expression %q: expected ')'", p.src)
+		}
+		p.next()
+
+		return inner, nil
+	}
+
+	field := p.next()
+	op := p.next()
+	value := p.next()
+	if p.pos > len(p.tokens) {
+		return nil, fmt.Errorf("filter expression %q: incomplete comparison", p.src)
+	}
+
+	return buildComparison(p.src, field, op, value)
+}
+
+func buildComparison(src, field, op, value string) (func(Attrs) bool, error) {
+	value = strings.Trim(value, `"`)
+
+	switch field {
+	case "path":
+		return buildPathComparison(src, op, value)
+	case "type":
+		return buildTypeComparison(src, op, value)
+	case "size":
+		return buildSizeComparison(src, op, value)
+	case "mtime":
+		return buildMtimeComparison(src, op, value)
+	case "uid":
+		return buildUintComparison(src, op, value, func(a Attrs) uint64 { return uint64(a.UID) })
+	case "gid":
+		return buildUintComparison(src, op, value, func(a Attrs) uint64 { return uint64(a.GID) })
+	default:
+		return nil, fmt.Errorf("filter expression %q: unknown field %q", src, field)
+	}
+}
+
+func buildPathComparison(src, op, value string) (func(Attrs) bool, error) {
+	switch op {
+	case "matches":
+		return func(a Attrs) bool {
+			matched, err := Match(value, a.Path)
+
+			return err == nil && matched
+		}, nil
+	case "==":
+		return func(a Attrs) bool { return a.Path == value }, nil
+	case "!=":
+		return func(a Attrs) bool { return a.Path != value }, nil
+	default:
+		return nil, fmt.Errorf("filter expression %q: operator %q not supported for path", src, op)
+	}
+}
+
+func buildTypeComparison(src, op, value string) (func(Attrs) bool, error) {
+	switch op {
+	case "==":
+		return func(a Attrs) bool { return a.Type == value }, nil
+	case "!=":
+		return func(a Attrs) bool { return a.Type != value }, nil
+	default:
+		return nil, fmt.Errorf("filter expression %q: operator %q not supported for type", src, op)
+	}
+}
+
+func buildSizeComparison(src, op, value string) (func(Attrs) bool, error) {
+	bytes, err := parseSize(value)
+	if err != nil {
+		return nil, fmt.Errorf("filter expression %q: %w", src, err)
+	}
+
+	cmp, err := compareUint(op)
+	if err != nil {
+		return nil, fmt.Errorf("filter expression %q: %w", src, err)
+	}
+
+	return func(a Attrs) bool { return cmp(a.Size, bytes) }, nil
+}
+
+func buildMtimeComparison(src, op, value string) (func(Attrs) bool, error) {
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, fmt.Errorf("filter expression %q: invalid date %q, expected YYYY-MM-DD", src, value)
+	}
+
+	switch op {
+	case "<":
+		return func(a Attrs) bool { return a.ModTime.Before(t) }, nil
+	case "<=":
+		return func(a Attrs) bool { return !a.ModTime.After(t) }, nil
+	case ">":
+		return func(a Attrs) bool { return a.ModTime.After(t) }, nil
+	case ">=":
+		return func(a Attrs) bool { return !a.ModTime.Before(t) }, nil
+	case "==":
+		return func(a Attrs) bool { return a.ModTime.Equal(t) }, nil
+	case "!=":
+		return func(a Attrs) bool { return !a.ModTime.Equal(t) }, nil
+	default:
+		return nil, fmt.Errorf("filter expression %q: operator %q not supported for mtime", src, op)
+	}
+}
+
+func buildUintComparison(src, op, value string, get func(Attrs) uint64) (func(Attrs) bool, error) {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("filter expression %q: invalid number %q", src, value)
+	}
+
+	cmp, err := compareUint(op)
+	if err != nil {
+		return nil, fmt.Errorf("filter expression %q: %w", src, err)
+	}
+
+	return func(a Attrs) bool { return cmp(get(a), n) }, nil
+}
+
+func compareUint(op string) (func(a, b uint64) bool, error) {
+	switch op {
+	case "<":
+		return func(a, b uint64) bool { return a < b }, nil
+	case "<=":
+		return func(a, b uint64) bool { return a <= b }, nil
+	case ">":
+		return func(a, b uint64) bool { return a > b }, nil
+	case ">=":
+		return func(a, b uint64) bool { return a >= b }, nil
+	case "==":
+		return func(a, b uint64) bool { return a == b }, nil
+	case "!=":
+		return func(a, b uint64) bool { return a != b }, nil
+	default:
+		return nil, fmt.Errorf("operator %q not supported", op)
+	}
+}
+
+// parseSize parses a byte count with the same k/K, m/M, g/G, t/T suffixes
+// accepted by --exclude-larger-than.
+func parseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	unit := uint64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		unit = 1 << 10
+	case 'm', 'M':
+		unit = 1 << 20
+	case 'g', 'G':
+		unit = 1 << 30
+	case 't', 'T':
+		unit = 1 << 40
+	}
+
+	numPart := s
+	if unit != 1 {
+		numPart = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseUint(numPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return n * unit, nil
+}
+
+// tokenize splits a filter expression into tokens. Quoted strings are kept
+// as a single token (including the quotes, which are stripped later).
+func tokenize(s string) []string {
+	var tokens []string
+
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				j++
+			}
+			if j < len(s) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], ">="),
+			strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case c == '<' || c == '>' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n()!<>", rune(s[j])) &&
+				!strings.HasPrefix(s[j:], "&&") && !strings.HasPrefix(s[j:], "||") {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+
+	return tokens
+}
@@ -0,0 +1,142 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func mustParseExpr(t *testing.T, s string) *Expr {
+	t.Helper()
+
+	expr, err := ParseExpr(s)
+	if err != nil {
+		t.Fatalf("ParseExpr(%q) returned error: %v", s, err)
+	}
+
+	return expr
+}
+
+func TestParseExprMatch(t *testing.T) {
+	mtime, err := time.Parse("2006-01-02", "2019-06-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := Attrs{
+		Path:    "/home/user/.cache/foo",
+		Size:    150 << 20,
+		ModTime: mtime,
+		UID:     1000,
+		GID:     1000,
+		Type:    "file",
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`path matches "**/.cache/**"`, true},
+		{`path matches "**/other/**"`, false},
+		{`path == "/home/user/.cache/foo"`, true},
+		{`path != "/home/user/.cache/foo"`, false},
+		{`size > 100M`, true},
+		{`size > 1G`, false},
+		{`size >= 150M && size <= 150M`, true},
+		{`mtime < 2020-01-01`, true},
+		{`mtime >= 2020-01-01`, false},
+		{`uid == 1000`, true},
+		{`gid != 1000`, false},
+		{`type == "file"`, true},
+		{`type == "dir"`, false},
+		{`!(type == "dir")`, true},
+		{`mtime < 2020-01-01 && size > 100M && !path matches "**/.cache/**"`, false},
+		{`path matches "**/.cache/**" || size > 1T`, true},
+		{`(size > 1T) || (path matches "**/.cache/**")`, true},
+	}
+
+	for _, tt := range tests {
+		expr := mustParseExpr(t, tt.expr)
+		if got := expr.Match(attrs); got != tt.want {
+			t.Errorf("ParseExpr(%q).Match(...) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`path`,
+		`path ==`,
+		`bogus == "x"`,
+		`path <= "x"`,
+		`size > 100X`,
+		`mtime < not-a-date`,
+		`uid == abc`,
+		`(path == "x"`,
+		`path == "x") `,
+	}
+
+	for _, expr := range tests {
+		if _, err := ParseExpr(expr); err == nil {
+			t.Errorf("ParseExpr(%q) unexpectedly succeeded", expr)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+	}{
+		{"0", 0},
+		{"100", 100},
+		{"1k", 1 << 10},
+		{"1K", 1 << 10},
+		{"2m", 2 << 20},
+		{"3G", 3 << 30},
+		{"1T", 1 << 40},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if err != nil {
+			t.Fatalf("parseSize(%q) returned error: %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := parseSize(""); err == nil {
+		t.Error("parseSize(\"\") unexpectedly succeeded")
+	}
+
+	if _, err := parseSize("abc"); err == nil {
+		t.Error(`parseSize("abc") unexpectedly succeeded`)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`path == "a"`, []string{"path", "==", `"a"`}},
+		{`a&&b`, []string{"a", "&&", "b"}},
+		{`!(a)`, []string{"!", "(", "a", ")"}},
+		{`size>=1M`, []string{"size", ">=", "1M"}},
+		{`path matches "a b c"`, []string{"path", "matches", `"a b c"`}},
+	}
+
+	for _, tt := range tests {
+		got := tokenize(tt.in)
+		if len(got) != len(tt.want) {
+			t.Fatalf("tokenize(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("tokenize(%q)[%d] = %q, want %q", tt.in, i, got[i], tt.want[i])
+			}
+		}
+	}
+}